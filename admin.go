@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/wfjsw/TcpRoute2/adminproto"
+)
+
+// handlerTimeoutForwardNs 是当前生效的转发空闲超时（纳秒），可以被管理协议的 set_timeout 命令动态调整，
+// 所以用 atomic 读写而不是普通常量。
+var handlerTimeoutForwardNs = int64(handlerTimeoutForwardDefault)
+
+// getHandlerTimeoutForward 返回当前生效的转发空闲超时。
+func getHandlerTimeoutForward() time.Duration {
+	return time.Duration(atomic.LoadInt64(&handlerTimeoutForwardNs))
+}
+
+// setHandlerTimeoutForward 设置转发空闲超时。TCP 转发只在 forwardConn 开始时取一次值，所以只影响之后新建立的连接；
+// SOCKS5 UDP ASSOCIATE 每次读取前都会重新取值，已有的 UDP 会话也会用上新值。
+func setHandlerTimeoutForward(d time.Duration) {
+	atomic.StoreInt64(&handlerTimeoutForwardNs, int64(d))
+}
+
+// reloadConfig 是 "reload" 命令的钩子，由 main 在启动时注入真正的配置重载逻辑。
+// 为 nil 时 reload 命令会原样报错，不会 panic。
+var reloadConfig func() error
+
+// AdminServer 是管理/控制端点，协议由 adminproto 定义。建议绑定在 127.0.0.1 等仅本机可达的地址上。
+// 客户端的每一帧都必须携带正确的 Token，没有单独的握手阶段。
+type AdminServer struct {
+	Token string
+}
+
+// ListenAndServe 监听 address 并处理后续所有管理连接，直到 Accept 出错为止。
+func (s *AdminServer) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("管理端口监听失败：%v", err)
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("管理端口接受连接失败：%v", err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *AdminServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		payload, err := adminproto.ReadFrame(r)
+		if err != nil {
+			return
+		}
+
+		var req adminproto.Request
+		if err := json.Unmarshal(payload, &req); err != nil {
+			adminproto.WriteFrame(conn, adminproto.Response{Error: fmt.Sprintf("请求格式错误：%v", err)})
+			return
+		}
+
+		// token 没有单独的握手帧，每一帧都要重新校验，防止劫持已认证的连接。
+		if subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.Token)) != 1 {
+			adminproto.WriteFrame(conn, adminproto.Response{Error: "认证失败"})
+			return
+		}
+
+		if err := adminproto.WriteFrame(conn, s.dispatch(req)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *AdminServer) dispatch(req adminproto.Request) adminproto.Response {
+	switch req.Command {
+	case "stats":
+		return adminproto.Response{OK: true, Data: snapshotStats()}
+
+	case "conns":
+		return adminproto.Response{OK: true, Data: snapshotConns()}
+
+	case "kill":
+		if len(req.Args) != 1 {
+			return adminproto.Response{Error: "kill 需要一个连接 id 参数"}
+		}
+		id, err := strconv.ParseUint(req.Args[0], 10, 64)
+		if err != nil {
+			return adminproto.Response{Error: fmt.Sprintf("连接 id 非法：%v", err)}
+		}
+		if !killConn(id) {
+			return adminproto.Response{Error: "连接不存在"}
+		}
+		return adminproto.Response{OK: true}
+
+	case "reload":
+		if reloadConfig == nil {
+			return adminproto.Response{Error: "当前启动方式未提供 reload 钩子"}
+		}
+		if err := reloadConfig(); err != nil {
+			return adminproto.Response{Error: err.Error()}
+		}
+		return adminproto.Response{OK: true}
+
+	case "set_timeout":
+		if len(req.Args) != 1 {
+			return adminproto.Response{Error: "set_timeout 需要一个时长参数，例如 10m"}
+		}
+		d, err := time.ParseDuration(req.Args[0])
+		if err != nil {
+			return adminproto.Response{Error: fmt.Sprintf("时长格式非法：%v", err)}
+		}
+		setHandlerTimeoutForward(d)
+		return adminproto.Response{OK: true}
+
+	default:
+		return adminproto.Response{Error: fmt.Sprintf("未知命令：%v", req.Command)}
+	}
+}
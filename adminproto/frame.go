@@ -0,0 +1,64 @@
+// Package adminproto 定义 tcproute2 管理/控制端点使用的帧格式，
+// 供主程序与 tcproute2ctl 共用，避免两边各自维护一份协议定义。
+package adminproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize 限制单帧 payload 的最大长度，防止异常对端发来畸形的超大长度头。
+const MaxFrameSize = 1 << 20 // 1MiB
+
+// Request 是客户端发送的一帧请求，Token 需要在每一帧里携带。
+type Request struct {
+	Token   string   `json:"token"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response 是服务端返回的一帧响应。
+type Response struct {
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// ReadFrame 读取一帧：4 字节大端长度 + JSON payload。
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("帧长度超限：%v", n)
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WriteFrame 把 v 编码成 JSON 后按 4 字节大端长度 + payload 的格式写出一帧。
+func WriteFrame(w io.Writer, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
+
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
@@ -0,0 +1,64 @@
+// tcproute2ctl 是 tcproute2 管理/控制端点的命令行客户端。
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/wfjsw/TcpRoute2/adminproto"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "管理端点地址")
+	token := flag.String("token", "", "管理端点认证 token")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "用法：tcproute2ctl -addr <host:port> -token <token> <stats|conns|kill <id>|reload|set_timeout <duration>>")
+		os.Exit(2)
+	}
+
+	if err := run(*addr, *token, args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "错误：", err)
+		os.Exit(1)
+	}
+}
+
+func run(addr, token, command string, args []string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("连接管理端点失败：%v", err)
+	}
+	defer conn.Close()
+
+	req := adminproto.Request{Token: token, Command: command, Args: args}
+	if err := adminproto.WriteFrame(conn, req); err != nil {
+		return fmt.Errorf("发送请求失败：%v", err)
+	}
+
+	payload, err := adminproto.ReadFrame(bufio.NewReader(conn))
+	if err != nil {
+		return fmt.Errorf("读取响应失败：%v", err)
+	}
+
+	var resp adminproto.Response
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return fmt.Errorf("响应格式错误：%v", err)
+	}
+
+	if !resp.OK {
+		return fmt.Errorf("%v", resp.Error)
+	}
+
+	out, err := json.MarshalIndent(resp.Data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("格式化响应失败：%v", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConn 是被管理端点追踪的一条转发连接。
+type trackedConn struct {
+	id         uint64
+	remoteAddr string
+	host       string
+	start      time.Time
+	count      *forwardCount
+	closeFunc  func() error
+}
+
+var (
+	connRegistry sync.Map // uint64 -> *trackedConn
+	connIDSeq    uint64
+
+	// closedSend/closedRecv 是已经结束的连接留下的收发字节数，进程生命周期内只增不减。
+	// snapshotStats 的 Total 是这两个值加上当前仍活跃的连接的计数，这样一条连接关闭、从
+	// connRegistry 里摘掉之后，它产生的流量不会从聚合统计里凭空消失。
+	closedSend uint64
+	closedRecv uint64
+)
+
+// registerConn 把一条新建立的转发连接登记到注册表，返回分配的 id。
+// forwardConn 在开始转发前调用，返回前通过 deregisterConn 清理。
+func registerConn(remoteAddr, host string, count *forwardCount, closeFunc func() error) uint64 {
+	id := atomic.AddUint64(&connIDSeq, 1)
+	connRegistry.Store(id, &trackedConn{
+		id:         id,
+		remoteAddr: remoteAddr,
+		host:       host,
+		start:      time.Now(),
+		count:      count,
+		closeFunc:  closeFunc,
+	})
+	return id
+}
+
+// deregisterConn 把连接从注册表中移除，并把它最终的收发字节数并入进程生命周期的累计总量。
+func deregisterConn(id uint64) {
+	v, ok := connRegistry.LoadAndDelete(id)
+	if !ok {
+		return
+	}
+	tc := v.(*trackedConn)
+	atomic.AddUint64(&closedSend, atomic.LoadUint64(&tc.count.Send))
+	atomic.AddUint64(&closedRecv, atomic.LoadUint64(&tc.count.Recv))
+}
+
+// killConn 关闭注册表中指定 id 的连接，使其转发 goroutine 因 Read/Write 出错而自然退出并被清理。
+// 返回 false 表示 id 不存在（可能已经自然结束）。
+func killConn(id uint64) bool {
+	v, ok := connRegistry.Load(id)
+	if !ok {
+		return false
+	}
+	v.(*trackedConn).closeFunc()
+	return true
+}
+
+// connInfo 是 "conns" 命令返回的单条连接信息。
+type connInfo struct {
+	ID         uint64       `json:"id"`
+	RemoteAddr string       `json:"remote_addr"`
+	Host       string       `json:"host,omitempty"`
+	Duration   string       `json:"duration"`
+	Count      forwardCount `json:"count"`
+}
+
+// snapshotConns 返回当前所有活跃连接的快照。
+func snapshotConns() []connInfo {
+	var out []connInfo
+	connRegistry.Range(func(_, v interface{}) bool {
+		tc := v.(*trackedConn)
+		out = append(out, connInfo{
+			ID:         tc.id,
+			RemoteAddr: tc.remoteAddr,
+			Host:       tc.host,
+			Duration:   time.Since(tc.start).String(),
+			Count: forwardCount{
+				Send: atomic.LoadUint64(&tc.count.Send),
+				Recv: atomic.LoadUint64(&tc.count.Recv),
+			},
+		})
+		return true
+	})
+	return out
+}
+
+// statsInfo 是 "stats" 命令返回的聚合统计信息。
+type statsInfo struct {
+	Total       forwardCount `json:"total"`
+	ActiveConns int          `json:"active_conns"`
+	Conns       []connInfo   `json:"conns"`
+}
+
+// snapshotStats 汇总进程启动以来的收发字节数：已关闭连接的累计总量加上当前活跃连接的计数。
+func snapshotStats() statsInfo {
+	conns := snapshotConns()
+	s := statsInfo{ActiveConns: len(conns), Conns: conns}
+	s.Total.Send = atomic.LoadUint64(&closedSend)
+	s.Total.Recv = atomic.LoadUint64(&closedRecv)
+	for _, c := range conns {
+		s.Total.Send += c.Count.Send
+		s.Total.Recv += c.Count.Recv
+	}
+	return s
+}
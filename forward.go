@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// forwardBufSize 是缓冲转发路径每次 Read/Write 使用的缓冲区大小。
+const forwardBufSize = 32 * 1024
+
+// forwardBufPool 是转发缓冲区的复用池，避免每个方向每条连接都重新分配 forwardBufSize 大小的切片。
+var forwardBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, forwardBufSize)
+	},
+}
+
+// forwardConn 在 sConn、oConn 之间双向转发数据。
+// preamble 非空时会在开始转发前原样写入 oConn，用于例如向上游透传 PROXY protocol 头。
+// host 是 Pre 嗅探出的目标域名（没有嗅探到就传空字符串），仅用于管理端点 conns 命令展示。
+// count 可以由多条连接共享；本连接的收发字节数单独计数并登记到连接注册表，在本函数返回时才并入 count。
+// 在 Linux 上、当 sConn、oConn 都是 *net.TCPConn 时会走 splice(2) 零拷贝路径，否则退回到带缓冲池的 Read/Write 循环。
+func forwardConn(sConn, oConn net.Conn, timeout time.Duration, count *forwardCount, preamble []byte, host string) error {
+	if len(preamble) > 0 {
+		if _, err := oConn.Write(preamble); err != nil {
+			return fmt.Errorf("写出前导头失败：%v", err)
+		}
+	}
+
+	connCount := &forwardCount{}
+	id := registerConn(sConn.RemoteAddr().String(), host, connCount, sConn.Close)
+	defer func() {
+		deregisterConn(id)
+		atomic.AddUint64(&count.Send, atomic.LoadUint64(&connCount.Send))
+		atomic.AddUint64(&count.Recv, atomic.LoadUint64(&connCount.Recv))
+	}()
+
+	errChan := make(chan error, 10)
+
+	go _forwardConn(sConn, oConn, timeout, errChan, &connCount.Send)
+	go _forwardConn(oConn, sConn, timeout, errChan, &connCount.Recv)
+
+	return <-errChan
+}
+
+// _forwardConn 把 sConn 的数据转发到 oConn，并把累计字节数记录到 count。
+func _forwardConn(sConn, oConn net.Conn, timeout time.Duration, errChan chan error, count *uint64) {
+	if canSplice(sConn, oConn) {
+		spliceForwardConn(sConn, oConn, timeout, errChan, count)
+		return
+	}
+	bufferedForwardConn(sConn, oConn, timeout, errChan, count)
+}
+
+// canSplice 判断是否可以用 (*net.TCPConn).ReadFrom 做内核态的 splice 转发。
+// TLS 等在用户态包装了 Read/Write 的连接不是 *net.TCPConn，会自然落到缓冲转发路径。
+//
+// 已知限制：经过 Pre() 嗅探的连接（HTTP/TLS/h2c 等默认端口场景，也是这个项目最主要的用途）
+// 在嗅探阶段会被 peekConn 和/或 go-vhost 的 sharedConn 包一层用来重放已读取的前导字节，
+// 包装之后整条连接生命周期里都不再是字面意义上的 *net.TCPConn，所以这条快路径目前只对完全
+// 跳过嗅探的路由生效；要覆盖嗅探场景，需要在确认嗅探阶段缓冲的前导字节已经通过普通
+// Read/Write 转发完之后，再把剩余数据转到底层 *net.TCPConn 上继续走 splice，这里暂未实现。
+func canSplice(sConn, oConn net.Conn) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, sOK := sConn.(*net.TCPConn)
+	_, oOK := oConn.(*net.TCPConn)
+	return sOK && oOK
+}
+
+// countingConn 包装 oConn，只在一次 ReadFrom 调用结束后按返回的总字节数更新一次计数，
+// 而不是像缓冲转发那样逐块累加，这样 splice 路径里内核态拷贝的数据完全不必经过用户态的计数逻辑。
+type countingConn struct {
+	net.Conn
+	count *uint64
+}
+
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.Conn.(*net.TCPConn).ReadFrom(r)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
+}
+
+// spliceForwardConn 使用 splice(2) 在内核态把 sConn 的数据搬运到 oConn。
+// splice 路径里没有逐块的 Read/Write 可以顺手刷新超时，所以改由一个 ticker 协程定期检查
+// count：只有上一轮检查之后确实发生了新的转发流量才重置两端的 deadline，否则保持 deadline
+// 不变，让它按原计划到期——不然一条彻底没有流量的连接会被无条件续期成永不超时。
+// 数据按 spliceChunkSize 分块交给 ReadFrom，count 每传完一块（或遇到 EOF）才增长一次，
+// 所以 ticker 看到的流量以块为粒度。
+func spliceForwardConn(sConn, oConn net.Conn, timeout time.Duration, errChan chan error, count *uint64) {
+	const spliceChunkSize = 64 * 1024
+
+	sConn.SetDeadline(time.Now().Add(timeout))
+	oConn.SetDeadline(time.Now().Add(timeout))
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		lastCount := atomic.LoadUint64(count)
+		for {
+			select {
+			case <-ticker.C:
+				if c := atomic.LoadUint64(count); c != lastCount {
+					lastCount = c
+					sConn.SetDeadline(time.Now().Add(timeout))
+					oConn.SetDeadline(time.Now().Add(timeout))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	cw := &countingConn{Conn: oConn, count: count}
+	for {
+		n, err := cw.ReadFrom(&io.LimitedReader{R: sConn, N: spliceChunkSize})
+		if err != nil {
+			if err == io.EOF {
+				errChan <- err
+			}else {
+				errChan <- fmt.Errorf("转发错误：%v", err)
+			}
+			return
+		}
+		if n < spliceChunkSize {
+			// 不足一块且没有错误说明 sConn 已经读到 EOF。
+			errChan <- io.EOF
+			return
+		}
+	}
+}
+
+// bufferedForwardConn 是 splice 不可用时的退路：从 forwardBufPool 取一个缓冲区，
+// 在用户态循环 Read/Write，每次循环都刷新一次超时时间。
+func bufferedForwardConn(sConn, oConn net.Conn, timeout time.Duration, errChan chan error, count *uint64) {
+	buf := forwardBufPool.Get().([]byte)
+	defer forwardBufPool.Put(buf)
+
+	for {
+		sConn.SetDeadline(time.Now().Add(timeout))
+		oConn.SetDeadline(time.Now().Add(timeout))
+		// 虽然存在 WriteTo 等方法，但是由于无法刷新超时时间，所以还是需要使用标准的 Read、Write。
+
+		n, err := sConn.Read(buf[:forwardBufSize])
+		if err != nil {
+			if err == io.EOF {
+				errChan <- err
+			}else {
+				errChan <- fmt.Errorf("转发读错误：%v", err)
+			}
+			return
+		}
+
+		wbuf := buf[:n]
+		for len(wbuf) > 0 {
+			n, err := oConn.Write(wbuf)
+			if err != nil {
+				if err == io.EOF {
+					errChan <- err
+				}else {
+					errChan <- fmt.Errorf("转发写错误：%v", err)
+				}
+				return
+			}
+			wbuf = wbuf[n:]
+		}
+
+		// 记录转发计数
+		atomic.AddUint64(count, uint64(n))
+	}
+}
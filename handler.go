@@ -3,28 +3,16 @@ import (
 	"fmt"
 	"net"
 	"time"
-	"io"
-	"sync/atomic"
 	"strings"
 	"strconv"
-	"github.com/inconshreveable/go-vhost"
 )
 
 const (
 	handlerTimeoutHello = 3 * time.Second// 握手 timeout 鉴定 + 接受 CMD 的总允许时间
 	handlerTimeoutConnect = 2 * time.Second// 连接目标地址超时
-	handlerTimeoutForward = 10 * time.Minute// 转发超时 每次转发数据都会重置这个超时时间
+	handlerTimeoutForwardDefault = 10 * time.Minute// 转发超时默认值 每次转发数据都会重置这个超时时间，可通过管理协议的 set_timeout 动态调整
 )
 
-const (
-	preProtocolUnknown = 0
-	preProtocolHttp = 1
-	preProtocolHttps = 2
-)
-
-var preHttpPorts = []int{80}
-var preHttpsPorts = []int{443}
-
 // NoHandle 无法处理的协议类型
 // 尝试通过 New 对连接创建 Handler 时，如果协议不匹配无法处理，那么就返回这个错误。
 type NoHandleError string
@@ -55,145 +43,75 @@ type HandlerNewer interface {
 // 转发计数
 // 使用 atomic 实现原子操作
 type forwardCount struct {
-	send, recv uint64
-}
-
-func forwardConn(sConn, oConn net.Conn, timeout time.Duration, count *forwardCount) error {
-	errChan := make(chan error, 10)
-
-	go _forwardConn(sConn, oConn, timeout, errChan, &count.send)
-	go _forwardConn(oConn, sConn, timeout, errChan, &count.recv)
-
-	return <-errChan
+	Send uint64 `json:"send"`
+	Recv uint64 `json:"recv"`
 }
 
-func _forwardConn(sConn, oConn net.Conn, timeout time.Duration, errChan chan error, count *uint64) {
-	buf := make([]byte, forwardBufSize)
-	for {
-		sConn.SetDeadline(time.Now().Add(timeout))
-		oConn.SetDeadline(time.Now().Add(timeout))
-		// 虽然存在 WriteTo 等方法，但是由于无法刷新超时时间，所以还是需要使用标准的 Read、Write。
-
-		if n, err := sConn.Read(buf[:forwardBufSize]); err != nil {
-			if err == io.EOF {
-				errChan <- err
-			}else {
-				errChan <- fmt.Errorf("转发读错误：%v", err)
-			}
-			return
-		}else {
-			buf = buf[:n]
-		}
-
-		wbuf := buf
-		for {
-			if len(wbuf) == 0 {
-				break
-			}
-
-			if n, err := oConn.Write(wbuf); err != nil {
-				if err == io.EOF {
-					errChan <- err
-				}else {
-					errChan <- fmt.Errorf("转发写错误：%v", err)
-				}
-				return
-			} else {
-				wbuf = wbuf[n:]
-			}
-		}
-
-		// 记录转发计数
-		atomic.AddUint64(count, uint64(len(buf)))
-	}
-}
-
-
 // 检查是否需要预处理
-// 返回预处理的协议
-// 目前只有当 address 是 ip 地址时才会进行预处理。
-func CheckPre(network, address string) int {
+// 目前只有当 address 是 ip 地址时才会进行预处理，具体匹配哪个嗅探器由 Pre 根据端口表
+// 或者（当 forceSniff 为 true 时）直接对数据包内容进行嗅探来决定。
+func CheckPre(network, address string) bool {
 
 	if strings.HasPrefix(network, "tcp") == false {
 		// 非 tcp 协议不处理
-		return preProtocolUnknown
+		return false
 	}
 
-	host, port, err := net.SplitHostPort(address)
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
 		// 地址异常不处理
-		return preProtocolUnknown
+		return false
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
+	if net.ParseIP(host) == nil {
 		// 目标地址非 ip 不处理
-		return preProtocolUnknown
+		return false
 	}
 
-	portInt, err := strconv.Atoi(port)
-	if err != nil {
-		// 端口异常不处理
-		return preProtocolUnknown
-	}
-
-	if in(portInt, preHttpPorts) {
-		// 匹配 http ，处理
-		return preProtocolHttp
-	}
-	if in(portInt, preHttpsPorts) {
-		// 匹配 http ，处理
-		return preProtocolHttps
-	}
-
-	return preProtocolUnknown
+	return true
 }
 
 // 预处理
-// 会尝试读取 http、https头的内容获得 域名来代替 address 的host部分，端口还是使用 address 的不变。
+// 依次按 address 的端口在 preSniffPorts 中查找匹配的 PreSniffer；如果 forceSniff 为 true 且
+// 按端口未匹配到任何嗅探器，则会改为对连接进行预读（不消耗数据），按内容强制匹配一个嗅探器。
+// 匹配成功后尝试读取协议头获得域名来代替 address 的 host 部分，端口还是使用 address 的不变。
 // 注意：要使用返回的连接代替当前连接，否则会丢失数据。
-func Pre(conn net.Conn, address string, preProtoco int) (nConn net.Conn, nAddress string, ok bool) {
+func Pre(conn net.Conn, address string, forceSniff bool) (nConn net.Conn, nAddress string, ok bool) {
 
-	httpRawHost := ""
-	tcpPort := ""
-
-	if _, tTcpPort, err := net.SplitHostPort(address); err == nil {
-		tcpPort = tTcpPort
-	}else {
+	_, tcpPort, err := net.SplitHostPort(address)
+	if err != nil {
 		return conn, address, false
 	}
 
-	switch preProtoco {
-	case preProtocolHttp:
-		c, err := vhost.HTTP(conn)
-		if err != nil {
-			return c, address, false
-		}
-		conn = c
-		httpRawHost = c.Host()
-		c.Free()
-
-	case preProtocolHttps:
-		c, err := vhost.TLS(conn)
-		if err != nil {
-			return c, address, false
+	var sniffer PreSniffer
+	if portInt, err := strconv.Atoi(tcpPort); err == nil {
+		sniffer = sniffByPort(portInt)
+	}
+
+	pConn := newPeekConn(conn)
+
+	if sniffer == nil && forceSniff {
+		peek, err := pConn.Peek(preSniffPeekSize)
+		if err != nil && len(peek) == 0 {
+			return conn, address, false
 		}
-		conn = c
-		httpRawHost = c.Host()
-		c.Free()
+		sniffer = sniffByPeek(peek)
+	}
 
-	default:
-		return conn, address, false
+	if sniffer == nil {
+		// 强制嗅探时预读的字节已经进了 pConn 的缓冲区，只能通过 pConn 读到。
+		return pConn, address, false
 	}
 
-	if httpRawHost == "" {
-		return conn, address, false
+	c, httpRawHost, err := sniffer.ExtractHost(pConn)
+	if err != nil || httpRawHost == "" {
+		return c, address, false
 	}
 
 	if tHost, _, err := net.SplitHostPort(httpRawHost); err != nil {
-		return conn, net.JoinHostPort(httpRawHost, tcpPort), true
+		return c, net.JoinHostPort(httpRawHost, tcpPort), true
 	}else {
-		return conn, net.JoinHostPort(tHost, tcpPort), true
+		return c, net.JoinHostPort(tHost, tcpPort), true
 	}
 }
 
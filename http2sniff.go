@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// alpnConn 包装 preSnifferTLS 返回的连接，附带从 ClientHello 里解析到的 ALPN 协议列表，
+// 方便 outbound 拨号时参考客户端声明的协议（典型地是 h2 或 http/1.1）。
+type alpnConn struct {
+	net.Conn
+	protocols []string
+}
+
+// ALPNProtocols 返回 TLS ClientHello 的 ALPN 扩展里声明的协议列表，顺序即客户端的偏好顺序；
+// 没有解析到 ALPN 扩展（或者根本不是 TLS）时返回 nil。
+func (c *alpnConn) ALPNProtocols() []string {
+	return c.protocols
+}
+
+// ConnALPNProtocols 取出 conn 上（如果有）preSnifferTLS 挂上去的 ALPN 协议列表。
+func ConnALPNProtocols(conn net.Conn) []string {
+	if c, ok := conn.(interface{ ALPNProtocols() []string }); ok {
+		return c.ALPNProtocols()
+	}
+	return nil
+}
+
+const tlsExtensionALPN = 0x10
+
+// peekTLSRecord 按 TLS 记录头里声明的长度去 Peek 一份 TLS 记录，而不是盲目地要求一个固定的
+// 大小——ClientHello 通常只有几百到一两千字节，按声明长度读取可以避免在数据不够时一直等到超时。
+func peekTLSRecord(pc *peekConn) []byte {
+	head, err := pc.Peek(5)
+	if err != nil {
+		return head
+	}
+
+	total := 5 + (int(head[3])<<8 | int(head[4]))
+	if total > peekConnBufSize {
+		total = peekConnBufSize
+	}
+
+	body, err := pc.Peek(total)
+	if err != nil {
+		return body
+	}
+	return body
+}
+
+// parseClientHelloALPN 从一份（可能不完整的）TLS ClientHello 记录里解析出 ALPN 扩展声明的
+// 协议列表。ALPN 只是锦上添花的信息，任何解析失败都返回 nil 而不是 error。
+func parseClientHelloALPN(record []byte) []string {
+	// record 层：ContentType(1)=0x16, Version(2), Length(2)
+	if len(record) < 5 || record[0] != 0x16 {
+		return nil
+	}
+	recLen := int(record[3])<<8 | int(record[4])
+	if len(record) < 5+recLen {
+		return nil
+	}
+	hs := record[5 : 5+recLen]
+
+	// Handshake 层：HandshakeType(1)=0x01 (ClientHello), Length(3)
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return nil
+	}
+	chLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+chLen {
+		return nil
+	}
+	ch := hs[4 : 4+chLen]
+
+	pos := 34 // client_version(2) + random(32)
+	if len(ch) < pos+1 {
+		return nil
+	}
+
+	pos += 1 + int(ch[pos]) // session_id
+	if len(ch) < pos+2 {
+		return nil
+	}
+
+	pos += 2 + (int(ch[pos])<<8 | int(ch[pos+1])) // cipher_suites
+	if len(ch) < pos+1 {
+		return nil
+	}
+
+	pos += 1 + int(ch[pos]) // compression_methods
+	if len(ch) < pos+2 {
+		return nil
+	}
+
+	extTotalLen := int(ch[pos])<<8 | int(ch[pos+1])
+	pos += 2
+	if len(ch) < pos+extTotalLen {
+		return nil
+	}
+	extensions := ch[pos : pos+extTotalLen]
+
+	epos := 0
+	for epos+4 <= len(extensions) {
+		extType := int(extensions[epos])<<8 | int(extensions[epos+1])
+		extLen := int(extensions[epos+2])<<8 | int(extensions[epos+3])
+		epos += 4
+		if epos+extLen > len(extensions) {
+			return nil
+		}
+		extBody := extensions[epos : epos+extLen]
+		epos += extLen
+
+		if extType == tlsExtensionALPN {
+			return parseALPNExtension(extBody)
+		}
+	}
+
+	return nil
+}
+
+func parseALPNExtension(body []byte) []string {
+	if len(body) < 2 {
+		return nil
+	}
+	listLen := int(body[0])<<8 | int(body[1])
+	list := body[2:]
+	if listLen > len(list) {
+		return nil
+	}
+	list = list[:listLen]
+
+	var protocols []string
+	pos := 0
+	for pos < len(list) {
+		n := int(list[pos])
+		pos++
+		if pos+n > len(list) {
+			return nil
+		}
+		protocols = append(protocols, string(list[pos:pos+n]))
+		pos += n
+	}
+	return protocols
+}
+
+// ---- h2c :authority 解析 ----
+
+const (
+	http2FrameHeaders      = 0x01
+	http2FrameContinuation = 0x09
+
+	http2FlagEndHeaders = 0x04
+	http2FlagPadded     = 0x08
+	http2FlagPriority   = 0x20
+
+	// http2MaxFramesBeforeHeaders 是在第一个 HEADERS 帧之前允许出现的其它帧（如 SETTINGS）数量上限，
+	// 防止恶意/异常客户端用没完没了的帧耗尽这里的等待。
+	http2MaxFramesBeforeHeaders = 32
+
+	// http2MaxContinuationFrames 限制首个 HEADERS 帧之后、END_HEADERS 到达之前允许出现的
+	// CONTINUATION 帧数量；http2MaxHeaderBlockSize 限制这期间累计的头部块字节数。不加这两个
+	// 上限的话，客户端可以一直不发 END_HEADERS、无限喂 CONTINUATION 帧把 headerBlock 撑爆
+	// （即 2024 年的 "HTTP/2 CONTINUATION Flood" 那一类打法）。
+	http2MaxContinuationFrames = 256
+	http2MaxHeaderBlockSize    = 64 * 1024
+)
+
+// readH2cAuthority 从 r 里依次读取 HTTP/2 帧，把首个 HEADERS 帧（可能被若干 CONTINUATION
+// 帧分片）的头部块拼起来，再用 HPACK 解码找出 :authority 伪头部。
+func readH2cAuthority(r io.Reader) (string, error) {
+	var headerBlock []byte
+	gotHeaders := false
+	continuationFrames := 0
+
+	for i := 0; ; i++ {
+		if !gotHeaders && i > http2MaxFramesBeforeHeaders {
+			return "", fmt.Errorf("HEADERS 帧之前出现了太多其它帧")
+		}
+
+		fh, err := readN(r, 9)
+		if err != nil {
+			return "", fmt.Errorf("读取帧头失败：%v", err)
+		}
+		length := int(fh[0])<<16 | int(fh[1])<<8 | int(fh[2])
+		typ := fh[3]
+		flags := fh[4]
+
+		// 帧头里的 length 完全由对端声明，不加上限的话光靠一个 9 字节的帧头就能让 readN
+		// 分配一整块最大 16MB 的缓冲区，body 可以一直不发——在 http2MaxFramesBeforeHeaders
+		// 帧的额度内就能反复触发。这里按 http2MaxHeaderBlockSize 设上限，在真正分配/读取
+		// 帧体之前就拒绝掉。
+		if length > http2MaxHeaderBlockSize {
+			return "", fmt.Errorf("帧长度超出上限：%d", length)
+		}
+
+		payload, err := readN(r, length)
+		if err != nil {
+			return "", fmt.Errorf("读取帧内容失败：%v", err)
+		}
+
+		switch typ {
+		case http2FrameHeaders:
+			if gotHeaders {
+				return "", fmt.Errorf("重复的 HEADERS 帧")
+			}
+			gotHeaders = true
+			frag, err := stripHeadersFramePadding(payload, flags)
+			if err != nil {
+				return "", err
+			}
+			headerBlock = append(headerBlock, frag...)
+			if len(headerBlock) > http2MaxHeaderBlockSize {
+				return "", fmt.Errorf("头部块超出大小上限")
+			}
+			if flags&http2FlagEndHeaders != 0 {
+				return decodeH2Authority(headerBlock)
+			}
+
+		case http2FrameContinuation:
+			if !gotHeaders {
+				return "", fmt.Errorf("在 HEADERS 帧之前出现了 CONTINUATION 帧")
+			}
+			continuationFrames++
+			if continuationFrames > http2MaxContinuationFrames {
+				return "", fmt.Errorf("CONTINUATION 帧数量超出上限")
+			}
+			headerBlock = append(headerBlock, payload...)
+			if len(headerBlock) > http2MaxHeaderBlockSize {
+				return "", fmt.Errorf("头部块超出大小上限")
+			}
+			if flags&http2FlagEndHeaders != 0 {
+				return decodeH2Authority(headerBlock)
+			}
+
+		default:
+			// SETTINGS 等帧在首个 HEADERS 帧之前完全合法；但 HEADERS 没结束（未见 END_HEADERS）
+			// 时按规范不能插入除 CONTINUATION 之外的帧。
+			if gotHeaders {
+				return "", fmt.Errorf("HEADERS 帧未结束时出现了其它类型的帧：0x%x", typ)
+			}
+		}
+	}
+}
+
+// stripHeadersFramePadding 剥掉 HEADERS 帧里 PADDED（可选的 1 字节 Pad Length + 尾部填充）
+// 和 PRIORITY（5 字节的流依赖 + 权重）字段，只留下真正的头部块片段。curl、nghttp2 系的客户端
+// 都会给首个 HEADERS 帧带上 PRIORITY 标志，不剥掉这 5 个字节会直接喂坏 HPACK 解码。
+func stripHeadersFramePadding(payload []byte, flags byte) ([]byte, error) {
+	padLen := 0
+	if flags&http2FlagPadded != 0 {
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("HEADERS 帧长度不足以容纳 Pad Length")
+		}
+		padLen = int(payload[0])
+		payload = payload[1:]
+	}
+
+	if flags&http2FlagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, fmt.Errorf("HEADERS 帧长度不足以容纳 PRIORITY 字段")
+		}
+		payload = payload[5:]
+	}
+
+	if padLen > len(payload) {
+		return nil, fmt.Errorf("HEADERS 帧的 Pad Length 超出帧体长度")
+	}
+	return payload[:len(payload)-padLen], nil
+}
+
+// decodeH2Authority 用 HPACK 解码 headerBlock，静态表、动态表引用和 Huffman 编码都由
+// golang.org/x/net/http2/hpack 处理，这里只挑出 :authority 的值。
+func decodeH2Authority(headerBlock []byte) (string, error) {
+	var authority string
+	found := false
+
+	decoder := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		if f.Name == ":authority" {
+			authority = f.Value
+			found = true
+		}
+	})
+
+	if _, err := decoder.Write(headerBlock); err != nil {
+		return "", fmt.Errorf("HPACK 解码失败：%v", err)
+	}
+	if err := decoder.Close(); err != nil {
+		return "", fmt.Errorf("HPACK 解码收尾失败：%v", err)
+	}
+
+	if !found {
+		return "", fmt.Errorf("HEADERS 中没有 :authority")
+	}
+	return authority, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// buildH2Frame 按 RFC 7540 §4.1 拼出一个 HTTP/2 帧：3 字节长度 + 1 字节类型 + 1 字节标志 +
+// 4 字节（保留位+）流标识符，这里流标识符固定填 1，测试不关心它。
+func buildH2Frame(typ, flags byte, payload []byte) []byte {
+	head := make([]byte, 9)
+	head[0] = byte(len(payload) >> 16)
+	head[1] = byte(len(payload) >> 8)
+	head[2] = byte(len(payload))
+	head[3] = typ
+	head[4] = flags
+	binary.BigEndian.PutUint32(head[5:9], 1)
+	return append(head, payload...)
+}
+
+func encodeHeaders(t *testing.T, fields []hpack.HeaderField) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for _, f := range fields {
+		if err := enc.WriteField(f); err != nil {
+			t.Fatalf("hpack 编码失败：%v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestReadH2cAuthorityContinuationFragmented(t *testing.T) {
+	block := encodeHeaders(t, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "example.com:8080"},
+		// 同名重复字段会走动态表索引而不是每次都整串字面量编码，顺带覆盖一下动态表引用的解码路径。
+		{Name: ":authority", Value: "example.com:8080"},
+	})
+
+	// 故意把头部块从中间切开，分别装进 HEADERS（不带 END_HEADERS）和 CONTINUATION 帧里，
+	// 模拟真实客户端把一个略大的头部集拆成多帧发送的情况。
+	split := len(block) / 2
+	var frames bytes.Buffer
+	frames.Write(buildH2Frame(http2FrameHeaders, 0x00, block[:split]))
+	frames.Write(buildH2Frame(http2FrameContinuation, http2FlagEndHeaders, block[split:]))
+
+	host, err := readH2cAuthority(&frames)
+	if err != nil {
+		t.Fatalf("readH2cAuthority 失败：%v", err)
+	}
+	if host != "example.com:8080" {
+		t.Fatalf("期望解出 host=example.com:8080，实际为 %q", host)
+	}
+}
+
+func TestReadH2cAuthorityStripsPriorityAndPadding(t *testing.T) {
+	block := encodeHeaders(t, []hpack.HeaderField{
+		{Name: ":authority", Value: "priority.example.com"},
+	})
+
+	// PADDED(1 字节 Pad Length + 2 字节尾部填充) + PRIORITY(4 字节流依赖 + 1 字节权重)，
+	// curl/nghttp2 系客户端常给首个 HEADERS 帧同时打上这两个标志位。
+	payload := []byte{2} // Pad Length
+	payload = append(payload, 0, 0, 0, 0, 0)
+	payload = append(payload, block...)
+	payload = append(payload, 0, 0) // 填充
+
+	frames := bytes.NewBuffer(buildH2Frame(http2FrameHeaders, http2FlagPadded|http2FlagPriority|http2FlagEndHeaders, payload))
+
+	host, err := readH2cAuthority(frames)
+	if err != nil {
+		t.Fatalf("readH2cAuthority 失败：%v", err)
+	}
+	if host != "priority.example.com" {
+		t.Fatalf("期望解出 host=priority.example.com，实际为 %q", host)
+	}
+}
+
+func TestReadH2cAuthorityRejectsUnboundedContinuation(t *testing.T) {
+	var frames bytes.Buffer
+	frames.Write(buildH2Frame(http2FrameHeaders, 0x00, []byte{0x00})) // 不带 END_HEADERS 的空字面量片段
+
+	for i := 0; i < http2MaxContinuationFrames+1; i++ {
+		frames.Write(buildH2Frame(http2FrameContinuation, 0x00, []byte{0x00}))
+	}
+
+	if _, err := readH2cAuthority(&frames); err == nil {
+		t.Fatal("期望 CONTINUATION 帧数量超限时返回错误，实际没有")
+	}
+}
+
+func TestReadH2cAuthorityRejectsOversizedFrameLength(t *testing.T) {
+	// 只给一个声明了超大长度（24 位长度字段能表示的最大值，约 16MB）的帧头，故意不提供
+	// 对应的帧体。在为帧体分配缓冲区之前就必须拒绝，而不是先 make() 一大块内存再因为
+	// 读不到数据而失败——那样的话恶意客户端光靠几个字节的帧头就能反复触发大块分配。
+	head := []byte{0xFF, 0xFF, 0xFF, http2FrameHeaders, 0x00, 0, 0, 0, 1}
+	frames := bytes.NewReader(head)
+
+	_, err := readH2cAuthority(frames)
+	if err == nil {
+		t.Fatal("期望超大帧长度返回错误，实际没有")
+	}
+	if got := err.Error(); !bytes.Contains([]byte(got), []byte("帧长度超出上限")) {
+		t.Fatalf("期望因帧长度超出上限而失败，实际错误是：%v", got)
+	}
+}
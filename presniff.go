@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/inconshreveable/go-vhost"
+)
+
+// preSniffPeekSize 强制嗅探时预读取的字节数，需要覆盖所有内置协议的特征串。
+const preSniffPeekSize = 64
+
+// peekConnBufSize 是 peekConn 内部 bufio.Reader 的缓冲区大小。
+// 放大到 16KiB 是为了让 preSnifferTLS 有机会在不消耗数据的前提下 Peek 到完整的 TLS
+// ClientHello（可能带有不少扩展，默认的 4KiB 缓冲区不一定够）。
+const peekConnBufSize = 16 * 1024
+
+// PreSniffer 是协议预嗅探器接口
+// CheckPre/Pre 用它在真正建立转发前识别客户端使用的协议并提取目标 host，
+// 以便用 host 而不是字面 ip 去重新决定转发目的地。
+type PreSniffer interface {
+	// Name 返回协议的唯一标识，用于 preSniffPorts 端口表匹配
+	Name() string
+	// Match 判断 peek 到的字节是否符合当前协议的特征，用于非标准端口上的强制嗅探
+	Match(peek []byte) bool
+	// ExtractHost 从 conn 中解析出目标 host，返回包装后可继续读取的连接
+	// 注意：conn 中已经被消费掉的数据只能通过 rewrittenConn 读到，调用方必须用它代替原连接。
+	ExtractHost(conn net.Conn) (rewrittenConn net.Conn, host string, err error)
+	// DefaultPorts 返回该协议默认绑定的端口，可以被主配置中的端口表覆盖
+	DefaultPorts() []int
+}
+
+// preSniffers 已注册的嗅探器，按注册顺序进行匹配
+var preSniffers []PreSniffer
+
+// preSniffPorts 每个嗅探器生效的端口集合，默认取自 DefaultPorts()，可以通过
+// ConfigurePreSniffPorts 用主配置中加载的端口表覆盖。
+var preSniffPorts = map[string][]int{}
+
+// RegisterPreSniffer 注册一个嗅探器，通常在 init() 中调用。
+func RegisterPreSniffer(s PreSniffer) {
+	preSniffers = append(preSniffers, s)
+	preSniffPorts[s.Name()] = s.DefaultPorts()
+}
+
+// ConfigurePreSniffPorts 用主配置中加载的端口表覆盖各嗅探器生效的端口。
+// 未出现在 ports 中的嗅探器保留其 DefaultPorts()。
+func ConfigurePreSniffPorts(ports map[string][]int) {
+	for _, s := range preSniffers {
+		preSniffPorts[s.Name()] = s.DefaultPorts()
+	}
+	for name, p := range ports {
+		preSniffPorts[name] = p
+	}
+}
+
+func init() {
+	RegisterPreSniffer(preSnifferHTTP{})
+	RegisterPreSniffer(preSnifferTLS{})
+	RegisterPreSniffer(preSnifferSSH{})
+	RegisterPreSniffer(preSnifferH2c{})
+}
+
+// sniffByPort 按目标端口查找生效的嗅探器，未配置该端口时返回 nil。
+func sniffByPort(port int) PreSniffer {
+	for _, s := range preSniffers {
+		if in(port, preSniffPorts[s.Name()]) {
+			return s
+		}
+	}
+	return nil
+}
+
+// sniffByPeek 不依赖目标端口，直接按已预读的字节强制匹配嗅探器。
+func sniffByPeek(peek []byte) PreSniffer {
+	for _, s := range preSniffers {
+		if s.Match(peek) {
+			return s
+		}
+	}
+	return nil
+}
+
+// peekConn 用 bufio.Reader 包装 net.Conn，使嗅探时的预读数据之后仍能被正常读到。
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	if pc, ok := conn.(*peekConn); ok {
+		return pc
+	}
+	return &peekConn{Conn: conn, r: bufio.NewReaderSize(conn, peekConnBufSize)}
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// Discard 跳过已经 Peek 过的 n 个字节，不会再被读到。
+func (c *peekConn) Discard(n int) (int, error) {
+	return c.r.Discard(n)
+}
+
+// ---- 内置嗅探器 ----
+
+// preSnifferHTTP 基于 go-vhost 识别 HTTP/1.x 请求行
+type preSnifferHTTP struct{}
+
+func (preSnifferHTTP) Name() string { return "http" }
+
+func (preSnifferHTTP) DefaultPorts() []int { return []int{80} }
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+func (preSnifferHTTP) Match(peek []byte) bool {
+	s := string(peek)
+	for _, m := range httpMethods {
+		if strings.HasPrefix(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (preSnifferHTTP) ExtractHost(conn net.Conn) (net.Conn, string, error) {
+	c, err := vhost.HTTP(conn)
+	if err != nil {
+		return c, "", err
+	}
+	host := c.Host()
+	c.Free()
+	return c, host, nil
+}
+
+// preSnifferTLS 基于 go-vhost 解析 TLS ClientHello 中的 SNI
+type preSnifferTLS struct{}
+
+func (preSnifferTLS) Name() string { return "tls" }
+
+func (preSnifferTLS) DefaultPorts() []int { return []int{443} }
+
+func (preSnifferTLS) Match(peek []byte) bool {
+	// TLS 记录层：0x16 (Handshake) + 主版本号 0x03
+	return len(peek) >= 2 && peek[0] == 0x16 && peek[1] == 0x03
+}
+
+// ExtractHost 除了用 go-vhost 取出 SNI 之外，还会顺手从 ClientHello 里解析 ALPN 扩展，
+// 挂在返回的连接上供 outbound 拨号时参考（典型地用来判断要不要对上游协商 h2）。
+// ALPN 解析失败不影响 SNI 嗅探本身，只是拿不到协议偏好而已。
+func (preSnifferTLS) ExtractHost(conn net.Conn) (net.Conn, string, error) {
+	pc := newPeekConn(conn)
+
+	alpn := parseClientHelloALPN(peekTLSRecord(pc))
+
+	c, err := vhost.TLS(pc)
+	if err != nil {
+		return c, "", err
+	}
+	host := c.Host()
+	c.Free()
+
+	return &alpnConn{Conn: c, protocols: alpn}, host, nil
+}
+
+// preSnifferSSH 识别 SSH 协议版本交换阶段发送的 banner
+type preSnifferSSH struct{}
+
+func (preSnifferSSH) Name() string { return "ssh" }
+
+func (preSnifferSSH) DefaultPorts() []int { return []int{22} }
+
+func (preSnifferSSH) Match(peek []byte) bool {
+	return strings.HasPrefix(string(peek), "SSH-2.0-")
+}
+
+// ExtractHost SSH 的 banner 不携带目标域名，识别到即可原样放行，按字面地址转发。
+func (preSnifferSSH) ExtractHost(conn net.Conn) (net.Conn, string, error) {
+	return conn, "", nil
+}
+
+// preSnifferH2c 识别 HTTP/2 明文（h2c）直连时客户端发送的前言
+type preSnifferH2c struct{}
+
+func (preSnifferH2c) Name() string { return "h2c" }
+
+// DefaultPorts h2c 没有约定俗成的默认端口，只能依赖强制嗅探。
+func (preSnifferH2c) DefaultPorts() []int { return []int{} }
+
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+func (preSnifferH2c) Match(peek []byte) bool {
+	s := string(peek)
+	return strings.HasPrefix(s, h2cPreface) || strings.HasPrefix(h2cPreface, s)
+}
+
+// ExtractHost 跳过前言之后读取第一个 HEADERS（可能被 CONTINUATION 分片）并用 HPACK
+// 解出 :authority 伪头部作为域名；解析失败时原样放行，按字面地址转发。
+func (preSnifferH2c) ExtractHost(conn net.Conn) (net.Conn, string, error) {
+	pc := newPeekConn(conn)
+
+	if _, err := pc.Peek(len(h2cPreface)); err != nil {
+		return pc, "", fmt.Errorf("读取 h2c 前言失败：%v", err)
+	}
+	if _, err := pc.Discard(len(h2cPreface)); err != nil {
+		return pc, "", err
+	}
+
+	host, err := readH2cAuthority(pc)
+	if err != nil {
+		return pc, "", err
+	}
+	return pc, host, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV1Prefix 是 PROXY protocol v1 文本头的固定前缀
+const proxyV1Prefix = "PROXY "
+
+// proxyV1MaxLen 是 PROXY protocol v1 头（含结尾 \r\n）允许的最大长度，参见协议规范
+const proxyV1MaxLen = 107
+
+// proxyV2Sig 是 PROXY protocol v2 头固定的二进制签名
+var proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyAddr 是从 PROXY 协议头中解出的来源地址，只用来替换 Conn.RemoteAddr()。
+type proxyAddr struct {
+	network string
+	addr    string
+}
+
+func (a proxyAddr) Network() string { return a.network }
+func (a proxyAddr) String() string  { return a.addr }
+
+// proxyConn 用 PROXY 协议头中携带的真实客户端地址覆盖底层连接的 RemoteAddr()，
+// 这样之后的 vhost 嗅探、日志记录看到的都是真实来源，而不是 HAProxy/Cloudflare 等前置代理的地址。
+type proxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// proxyProtoNewer 是一个 HandlerNewer：识别入站的 PROXY protocol v1/v2 头部，解析出真实
+// 来源地址后，把连接交给与普通路由相同的 CheckPre/Pre + 转发流水线处理。
+type proxyProtoNewer struct {
+	dial       func(network, address string) (net.Conn, error)
+	target     string
+	forceSniff bool
+	proxyOut   bool
+	count      *forwardCount
+}
+
+// NewProxyProtoNewer 创建一个识别 PROXY protocol 的 HandlerNewer。
+// target 是该路由固定转发到的目标地址；forceSniff 透传给 Pre 用于非标准端口的强制嗅探；
+// proxyOut 为 true 时会在连上目标地址后先写出一个 PROXY v2 头，把真实来源透传给上游。
+func NewProxyProtoNewer(dial func(network, address string) (net.Conn, error), target string, forceSniff bool, proxyOut bool, count *forwardCount) HandlerNewer {
+	return &proxyProtoNewer{dial: dial, target: target, forceSniff: forceSniff, proxyOut: proxyOut, count: count}
+}
+
+func (n *proxyProtoNewer) New(conn net.Conn) (Handler, bool, error) {
+	// PROXY 头必须在握手超时内到达，否则视为无法识别。
+	conn.SetReadDeadline(time.Now().Add(handlerTimeoutHello))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := newPeekConn(conn)
+
+	if sig, err := pc.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(sig, proxyV2Sig) {
+		addr, err := readProxyV2(pc)
+		if err != nil {
+			return nil, true, NoHandleError(fmt.Sprintf("PROXY v2 头解析失败：%v", err))
+		}
+		return n.newHandler(pc, addr), false, nil
+	}
+
+	if prefix, err := pc.Peek(len(proxyV1Prefix)); err == nil && string(prefix) == proxyV1Prefix {
+		addr, err := readProxyV1(pc)
+		if err != nil {
+			return nil, true, NoHandleError(fmt.Sprintf("PROXY v1 头解析失败：%v", err))
+		}
+		return n.newHandler(pc, addr), false, nil
+	}
+
+	return nil, true, NoHandleError("不是 PROXY 协议头")
+}
+
+// newHandler 如果解出了真实来源地址（非本地健康检查帧）就替换 RemoteAddr，再构造 Handler。
+func (n *proxyProtoNewer) newHandler(conn net.Conn, addr net.Addr) Handler {
+	if addr != nil {
+		conn = &proxyConn{Conn: conn, remoteAddr: addr}
+	}
+	return &proxyProtoHandler{conn: conn, newer: n}
+}
+
+// proxyProtoHandler 解析完 PROXY 头之后，沿用普通路由的转发逻辑把数据送到目标地址。
+type proxyProtoHandler struct {
+	conn  net.Conn
+	newer *proxyProtoNewer
+}
+
+func (h *proxyProtoHandler) String() string { return "proxy-protocol" }
+
+func (h *proxyProtoHandler) Handle() error {
+	conn := h.conn
+	address := h.newer.target
+	host := ""
+
+	if CheckPre("tcp", address) {
+		// Pre 内部的 ExtractHost 可能要读取完整的 ClientHello 或若干个 HTTP/2 帧，
+		// 期间必须保持一个超时，否则客户端可以一直不发完数据来占住连接。
+		conn.SetReadDeadline(time.Now().Add(handlerTimeoutHello))
+		c, nAddress, ok := Pre(conn, address, h.newer.forceSniff)
+		conn.SetReadDeadline(time.Time{})
+		// c 必须无条件替换 conn：即使 ok 为 false，ExtractHost 也可能已经从 conn 上消费了数据
+		// （比如一个没有 Host 头的合法 HTTP/1.0 请求），只是没嗅探出 host 而已，这些数据只有
+		// 通过 c 才读得到。
+		conn = c
+		if ok {
+			address = nAddress
+			host, _, _ = net.SplitHostPort(nAddress)
+		}
+	}
+
+	oConn, err := h.newer.dial("tcp", address)
+	if err != nil {
+		return fmt.Errorf("连接目标地址失败：%v", err)
+	}
+	defer oConn.Close()
+
+	var preamble []byte
+	if h.newer.proxyOut {
+		preamble = buildProxyV2Header(conn.RemoteAddr(), oConn.RemoteAddr())
+	}
+
+	return forwardConn(conn, oConn, getHandlerTimeoutForward(), h.newer.count, preamble, host)
+}
+
+// readProxyV1 解析 "PROXY TCP4/TCP6 <src> <dst> <srcport> <dstport>\r\n" 或
+// "PROXY UNKNOWN...\r\n"，返回来源地址；UNKNOWN（本地健康检查帧）返回 nil, nil。
+func readProxyV1(pc *peekConn) (net.Addr, error) {
+	peek, _ := pc.Peek(proxyV1MaxLen)
+
+	idx := bytes.Index(peek, []byte("\r\n"))
+	if idx < 0 {
+		return nil, fmt.Errorf("头部过长或缺少结束符")
+	}
+
+	line := string(peek[:idx])
+	if _, err := pc.Discard(idx + 2); err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("格式错误：%q", line)
+	}
+
+	if fields[1] == "UNKNOWN" {
+		// 本地健康检查等场景，不携带真实来源，调用方应原样放行。
+		return nil, nil
+	}
+
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("不支持的协议族：%v", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("字段数错误：%q", line)
+	}
+
+	srcIP, srcPort := fields[2], fields[4]
+	if net.ParseIP(srcIP) == nil {
+		return nil, fmt.Errorf("来源地址非法：%v", srcIP)
+	}
+	if _, err := strconv.Atoi(srcPort); err != nil {
+		return nil, fmt.Errorf("来源端口非法：%v", srcPort)
+	}
+
+	return proxyAddr{network: "tcp", addr: net.JoinHostPort(srcIP, srcPort)}, nil
+}
+
+// readProxyV2 解析二进制 PROXY protocol v2 头，返回来源地址；LOCAL 命令（本地健康检查）
+// 或无法识别的地址族返回 nil, nil。
+func readProxyV2(pc *peekConn) (net.Addr, error) {
+	header, err := pc.Peek(16)
+	if err != nil {
+		return nil, fmt.Errorf("头部不完整：%v", err)
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("不支持的版本号：0x%x", verCmd)
+	}
+	cmd := verCmd & 0x0F
+
+	famProto := header[13]
+	family := famProto >> 4
+	addrLen := int(binary.BigEndian.Uint16(header[14:16]))
+
+	total := 16 + addrLen
+	body, err := pc.Peek(total)
+	if err != nil {
+		return nil, fmt.Errorf("地址块不完整：%v", err)
+	}
+	if _, err := pc.Discard(total); err != nil {
+		return nil, err
+	}
+
+	if cmd == 0x00 {
+		// LOCAL：代理自身发起的健康检查连接，不携带真实来源。
+		return nil, nil
+	}
+
+	addrBody := body[16:]
+	switch family {
+	case 0x1: // AF_INET
+		if len(addrBody) < 12 {
+			return nil, fmt.Errorf("IPv4 地址块过短")
+		}
+		srcIP := net.IP(addrBody[0:4])
+		srcPort := binary.BigEndian.Uint16(addrBody[8:10])
+		return proxyAddr{network: "tcp", addr: net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort)))}, nil
+
+	case 0x2: // AF_INET6
+		if len(addrBody) < 36 {
+			return nil, fmt.Errorf("IPv6 地址块过短")
+		}
+		srcIP := net.IP(addrBody[0:16])
+		srcPort := binary.BigEndian.Uint16(addrBody[32:34])
+		return proxyAddr{network: "tcp", addr: net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort)))}, nil
+
+	default:
+		// AF_UNSPEC/AF_UNIX 等，多见于本地健康检查帧，不替换来源地址。
+		return nil, nil
+	}
+}
+
+// buildProxyV2Header 构造一个携带 src -> dst 地址信息的 PROXY protocol v2 头，
+// 用于 outbound 一侧把真实客户端地址透传给上游服务器。
+func buildProxyV2Header(src, dst net.Addr) []byte {
+	srcHost, srcPortStr, err := net.SplitHostPort(src.String())
+	if err != nil {
+		return nil
+	}
+	dstHost, dstPortStr, err := net.SplitHostPort(dst.String())
+	if err != nil {
+		return nil
+	}
+
+	srcIP := net.ParseIP(srcHost)
+	dstIP := net.ParseIP(dstHost)
+	if srcIP == nil || dstIP == nil {
+		return nil
+	}
+
+	srcPort, err := strconv.Atoi(srcPortStr)
+	if err != nil {
+		return nil
+	}
+	dstPort, err := strconv.Atoi(dstPortStr)
+	if err != nil {
+		return nil
+	}
+
+	var famProto byte
+	var addrBody []byte
+
+	if ip4src := srcIP.To4(); ip4src != nil {
+		ip4dst := dstIP.To4()
+		if ip4dst == nil {
+			return nil
+		}
+		famProto = 0x11 // AF_INET(1)<<4 | STREAM(1)
+		addrBody = make([]byte, 12)
+		copy(addrBody[0:4], ip4src)
+		copy(addrBody[4:8], ip4dst)
+		binary.BigEndian.PutUint16(addrBody[8:10], uint16(srcPort))
+		binary.BigEndian.PutUint16(addrBody[10:12], uint16(dstPort))
+	} else {
+		famProto = 0x21 // AF_INET6(2)<<4 | STREAM(1)
+		addrBody = make([]byte, 36)
+		copy(addrBody[0:16], srcIP.To16())
+		copy(addrBody[16:32], dstIP.To16())
+		binary.BigEndian.PutUint16(addrBody[32:34], uint16(srcPort))
+		binary.BigEndian.PutUint16(addrBody[34:36], uint16(dstPort))
+	}
+
+	header := make([]byte, 0, 16+len(addrBody))
+	header = append(header, proxyV2Sig...)
+	header = append(header, 0x21) // ver=2, cmd=PROXY
+	header = append(header, famProto)
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(addrBody)))
+	header = append(header, lenBuf...)
+	header = append(header, addrBody...)
+
+	return header
+}
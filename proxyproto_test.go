@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestProxyConn(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestReadProxyV1Truncated(t *testing.T) {
+	conn := newTestProxyConn(t, []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234")) // 缺少结尾 \r\n
+	pc := newPeekConn(conn)
+	if _, err := readProxyV1(pc); err == nil {
+		t.Fatal("期望截断的 v1 头返回错误，实际没有")
+	}
+}
+
+func TestReadProxyV1Unknown(t *testing.T) {
+	conn := newTestProxyConn(t, []byte("PROXY UNKNOWN\r\n\r\n"))
+	pc := newPeekConn(conn)
+	addr, err := readProxyV1(pc)
+	if err != nil {
+		t.Fatalf("UNKNOWN 帧不应返回错误：%v", err)
+	}
+	if addr != nil {
+		t.Fatalf("UNKNOWN 帧不应解出来源地址，实际得到 %v", addr)
+	}
+}
+
+func buildProxyV2Frame(verCmd, famProto byte, addrBody []byte) []byte {
+	header := make([]byte, 16)
+	copy(header, proxyV2Sig)
+	header[12] = verCmd
+	header[13] = famProto
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrBody)))
+	return append(header, addrBody...)
+}
+
+func TestReadProxyV2LocalHealthCheck(t *testing.T) {
+	// ver=2, cmd=0x0 (LOCAL)：代理自身发起的健康检查连接，不携带真实来源。
+	frame := buildProxyV2Frame(0x20, 0x00, nil)
+	conn := newTestProxyConn(t, frame)
+	pc := newPeekConn(conn)
+	addr, err := readProxyV2(pc)
+	if err != nil {
+		t.Fatalf("LOCAL 帧不应返回错误：%v", err)
+	}
+	if addr != nil {
+		t.Fatalf("LOCAL 帧不应解出来源地址，实际得到 %v", addr)
+	}
+}
+
+func TestReadProxyV2UnspecFamily(t *testing.T) {
+	// ver=2, cmd=0x1 (PROXY)，但地址族是 AF_UNSPEC，同样应视为无真实来源而原样放行。
+	frame := buildProxyV2Frame(0x21, 0x00, nil)
+	conn := newTestProxyConn(t, frame)
+	pc := newPeekConn(conn)
+	addr, err := readProxyV2(pc)
+	if err != nil {
+		t.Fatalf("AF_UNSPEC 帧不应返回错误：%v", err)
+	}
+	if addr != nil {
+		t.Fatalf("AF_UNSPEC 帧不应解出来源地址，实际得到 %v", addr)
+	}
+}
+
+func TestReadProxyV2Truncated(t *testing.T) {
+	// 只给签名加 3 个字节，凑不齐 16 字节的定长头部。
+	frame := append(append([]byte{}, proxyV2Sig...), 0x21, 0x11, 0x00)
+	conn := newTestProxyConn(t, frame)
+	pc := newPeekConn(conn)
+	if _, err := readProxyV2(pc); err == nil {
+		t.Fatal("期望截断的 v2 头返回错误，实际没有")
+	}
+}
+
+// deadlineRecordingConn 包装 net.Conn，记录每次 SetReadDeadline 的调用值，
+// 用来验证调用方确实在等待 PROXY 头期间设置了超时，而不必真的等待整个 handlerTimeoutHello。
+type deadlineRecordingConn struct {
+	net.Conn
+	deadlines []time.Time
+}
+
+func (c *deadlineRecordingConn) SetReadDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestProxyProtoNewerEnforcesHelloTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	rec := &deadlineRecordingConn{Conn: server}
+
+	done := make(chan struct{})
+	go func() {
+		newer := NewProxyProtoNewer(nil, "", false, false, &forwardCount{})
+		newer.New(rec)
+		close(done)
+	}()
+
+	// 给 New() 一点时间把 deadline 设置好，再主动关闭连接让阻塞的 Peek 以 EOF 收场，
+	// 这样测试不需要真的等满 handlerTimeoutHello 才能验证到超时确实被设置过。
+	time.Sleep(20 * time.Millisecond)
+	client.Close()
+	<-done
+
+	if len(rec.deadlines) == 0 {
+		t.Fatal("New() 应该在等待 PROXY 头期间设置 ReadDeadline")
+	}
+	wantAround := time.Now().Add(handlerTimeoutHello)
+	diff := rec.deadlines[0].Sub(wantAround)
+	if diff < -time.Second || diff > time.Second {
+		t.Fatalf("ReadDeadline 应该约为 handlerTimeoutHello 之后，实际 %v（期望接近 %v）", rec.deadlines[0], wantAround)
+	}
+}
+
+// TestProxyProtoHandlerReplaysConsumedBytesOnFailedSniff 复现一个真实场景：一个没有
+// Host 头的合法 HTTP/1.0 请求会让 Pre() 因为嗅探不到域名而返回 ok=false，但 ExtractHost
+// 已经把请求字节读进了它返回的连接里。Handle() 必须无条件改用这个连接，否则这些字节会
+// 被悄悄丢弃，上游永远等不到请求。
+func TestProxyProtoHandlerReplaysConsumedBytesOnFailedSniff(t *testing.T) {
+	const request = "GET / HTTP/1.0\r\n\r\n"
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go clientConn.Write([]byte(request))
+
+	upstreamRead, upstreamWrite := net.Pipe()
+	defer upstreamRead.Close()
+	defer upstreamWrite.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(request))
+		io.ReadFull(upstreamRead, buf)
+		received <- buf
+	}()
+
+	newer := &proxyProtoNewer{
+		dial:   func(network, address string) (net.Conn, error) { return upstreamWrite, nil },
+		target: "127.0.0.1:80",
+		count:  &forwardCount{},
+	}
+	h := &proxyProtoHandler{conn: serverConn, newer: newer}
+	go h.Handle()
+
+	select {
+	case got := <-received:
+		if string(got) != request {
+			t.Fatalf("期望转发出原始请求 %q，实际收到 %q", request, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("超时：嗅探消费掉的请求字节没有被转发出去")
+	}
+}
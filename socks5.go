@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth   = 0x00
+	socks5MethodUserPass = 0x02
+	socks5MethodNoAccept = 0xFF
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepCommandNotSupported = 0x07
+	socks5RepAddressNotSupported = 0x08
+)
+
+// socks5Newer 是一个 HandlerNewer：识别 SOCKS5 握手（RFC 1928），支持 NO AUTH 和
+// USERNAME/PASSWORD（RFC 1929）两种方式，再分别处理 CONNECT 与 UDP ASSOCIATE 命令。
+type socks5Newer struct {
+	dial        func(network, address string) (net.Conn, error)
+	credentials map[string]string // 用户名 -> 密码，为空表示只接受 NO AUTH
+	forceSniff  bool
+	count       *forwardCount
+}
+
+// NewSocks5Newer 创建一个 SOCKS5 的 HandlerNewer。
+// credentials 为空时只声明 NO AUTH 方式；非空时只声明 USERNAME/PASSWORD 方式并按表校验。
+func NewSocks5Newer(dial func(network, address string) (net.Conn, error), credentials map[string]string, forceSniff bool, count *forwardCount) HandlerNewer {
+	return &socks5Newer{dial: dial, credentials: credentials, forceSniff: forceSniff, count: count}
+}
+
+func (n *socks5Newer) New(conn net.Conn) (Handler, bool, error) {
+	conn.SetReadDeadline(time.Now().Add(handlerTimeoutHello))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := newPeekConn(conn)
+
+	head, err := pc.Peek(2)
+	if err != nil || head[0] != socks5Version {
+		return nil, true, NoHandleError("不是 SOCKS5 协议")
+	}
+	nMethods := int(head[1])
+
+	greeting, err := pc.Peek(2 + nMethods)
+	if err != nil {
+		return nil, true, NoHandleError("SOCKS5 问候帧不完整")
+	}
+	if _, err := pc.Discard(2 + nMethods); err != nil {
+		return nil, true, NoHandleError(fmt.Sprintf("SOCKS5 问候帧读取失败：%v", err))
+	}
+
+	method := n.selectMethod(greeting[2:])
+	if err := writeAll(pc, []byte{socks5Version, method}); err != nil {
+		return nil, false, fmt.Errorf("写出方法选择响应失败：%v", err)
+	}
+	if method == socks5MethodNoAccept {
+		return nil, false, fmt.Errorf("客户端不支持服务端可接受的认证方式")
+	}
+
+	if method == socks5MethodUserPass {
+		if err := n.authUserPass(pc); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &socks5Handler{newer: n, conn: pc}, false, nil
+}
+
+// selectMethod 按 n.credentials 是否为空决定只声明 NO AUTH 还是只声明 USERNAME/PASSWORD，
+// 两者都未出现在客户端提供的 methods 里时回落到 NO ACCEPTABLE METHODS。
+func (n *socks5Newer) selectMethod(methods []byte) byte {
+	want := byte(socks5MethodNoAuth)
+	if len(n.credentials) > 0 {
+		want = socks5MethodUserPass
+	}
+	for _, m := range methods {
+		if m == want {
+			return want
+		}
+	}
+	return socks5MethodNoAccept
+}
+
+// authUserPass 实现 RFC 1929 的用户名/密码子协商。
+func (n *socks5Newer) authUserPass(conn net.Conn) error {
+	pc := newPeekConn(conn)
+
+	head, err := pc.Peek(2)
+	if err != nil {
+		return fmt.Errorf("读取认证子协商头失败：%v", err)
+	}
+	uLen := int(head[1])
+
+	withUser, err := pc.Peek(2 + uLen + 1)
+	if err != nil {
+		return fmt.Errorf("读取用户名失败：%v", err)
+	}
+	pLen := int(withUser[2+uLen])
+
+	full, err := pc.Peek(2 + uLen + 1 + pLen)
+	if err != nil {
+		return fmt.Errorf("读取密码失败：%v", err)
+	}
+	if _, err := pc.Discard(len(full)); err != nil {
+		return err
+	}
+
+	username := string(full[2 : 2+uLen])
+	password := string(full[2+uLen+1:])
+
+	status := byte(0x01)
+	if pass, ok := n.credentials[username]; ok && pass == password {
+		status = 0x00
+	}
+
+	if err := writeAll(pc, []byte{0x01, status}); err != nil {
+		return fmt.Errorf("写出认证响应失败：%v", err)
+	}
+	if status != 0x00 {
+		return fmt.Errorf("用户名或密码错误")
+	}
+	return nil
+}
+
+// socks5Handler 处理完握手之后的 SOCKS5 请求：CONNECT 和 UDP ASSOCIATE。
+type socks5Handler struct {
+	newer *socks5Newer
+	conn  net.Conn
+}
+
+func (h *socks5Handler) String() string { return "socks5" }
+
+func (h *socks5Handler) Handle() error {
+	conn := h.conn
+	conn.SetReadDeadline(time.Now().Add(handlerTimeoutHello))
+
+	header, err := readN(conn, 4)
+	if err != nil {
+		return fmt.Errorf("读取请求头失败：%v", err)
+	}
+	if header[0] != socks5Version {
+		h.reply(conn, socks5RepGeneralFailure, nil)
+		return fmt.Errorf("请求版本号错误：0x%x", header[0])
+	}
+
+	cmd := header[1]
+	atyp := header[3]
+
+	address, err := readSocks5Addr(conn, atyp)
+	if err != nil {
+		h.reply(conn, socks5RepAddressNotSupported, nil)
+		return fmt.Errorf("解析目标地址失败：%v", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	switch cmd {
+	case socks5CmdConnect:
+		return h.handleConnect(address)
+	case socks5CmdUDPAssociate:
+		return h.handleUDPAssociate(conn)
+	default:
+		h.reply(conn, socks5RepCommandNotSupported, nil)
+		return fmt.Errorf("不支持的命令：0x%x", cmd)
+	}
+}
+
+// handleConnect 实现 CONNECT 命令。
+// 先回复成功，客户端之后才会把应用层数据发过来，Pre 才有数据可嗅探；嗅探完成、
+// 可能得到真实域名之后再真正拨号，这样字面 ip + 80/443 的连接也能被 vhost 重写成域名。
+func (h *socks5Handler) handleConnect(address string) error {
+	conn := h.conn
+
+	h.reply(conn, socks5RepSucceeded, nil)
+
+	if CheckPre("tcp", address) {
+		// Pre 内部的 ExtractHost 可能要读取完整的 ClientHello 或若干个 HTTP/2 帧，
+		// 期间必须保持一个超时，否则客户端可以一直不发完数据来占住连接。
+		conn.SetReadDeadline(time.Now().Add(handlerTimeoutHello))
+		c, nAddress, ok := Pre(conn, address, h.newer.forceSniff)
+		conn.SetReadDeadline(time.Time{})
+		// c 必须无条件替换 conn：即使 ok 为 false，ExtractHost 也可能已经从 conn 上消费了数据
+		// （比如一个没有 Host 头的合法 HTTP/1.0 请求），只是没嗅探出 host 而已，这些数据只有
+		// 通过 c 才读得到。
+		conn = c
+		if ok {
+			address = nAddress
+		}
+	}
+
+	oConn, err := h.newer.dial("tcp", address)
+	if err != nil {
+		return fmt.Errorf("连接目标地址失败：%v", err)
+	}
+	defer oConn.Close()
+
+	host, _, _ := net.SplitHostPort(address)
+	return forwardConn(conn, oConn, getHandlerTimeoutForward(), h.newer.count, nil, host)
+}
+
+// handleUDPAssociate 实现 UDP ASSOCIATE 命令：开一个临时 UDP 端口用于转发，
+// TCP 控制连接作为整个会话的生命周期锚点，控制连接一断 UDP 转发也要结束。
+func (h *socks5Handler) handleUDPAssociate(conn net.Conn) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		h.reply(conn, socks5RepGeneralFailure, nil)
+		return fmt.Errorf("创建 UDP 转发端口失败：%v", err)
+	}
+	defer udpConn.Close()
+
+	h.reply(conn, socks5RepSucceeded, udpConn.LocalAddr())
+
+	controlClosed := make(chan struct{})
+	go func() {
+		// 控制连接本身不会再有业务数据，Read 只会在对端关闭或超时时返回。
+		io.Copy(io.Discard, conn)
+		close(controlClosed)
+	}()
+
+	udpErrChan := make(chan error, 1)
+	go func() {
+		udpErrChan <- h.serveUDPAssociate(udpConn, controlClosed)
+	}()
+
+	select {
+	case <-controlClosed:
+		return fmt.Errorf("TCP 控制连接已关闭")
+	case err := <-udpErrChan:
+		return err
+	}
+}
+
+// serveUDPAssociate 读取客户端发来的 SOCKS5 UDP 数据包，解出目标地址后转发，
+// 并为每个（客户端来源地址, 目标地址）组合维护一个到该目标的 UDP 连接用于接收回包。
+func (h *socks5Handler) serveUDPAssociate(udpConn *net.UDPConn, controlClosed chan struct{}) error {
+	// RFC 1928 §7：收到的数据包来源地址必须和发起 UDP ASSOCIATE 的控制连接一致，否则丢弃，
+	// 不然任何能猜到/嗅探到这个临时端口号的人都能把它当成一个面向任意目标的开放 UDP 中继来用。
+	controlAddr, _ := h.conn.RemoteAddr().(*net.TCPAddr)
+
+	targets := map[string]net.Conn{}
+	defer func() {
+		for _, t := range targets {
+			t.Close()
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		udpConn.SetReadDeadline(time.Now().Add(getHandlerTimeoutForward()))
+
+		n, clientAddr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("读取 UDP 数据失败：%v", err)
+		}
+
+		select {
+		case <-controlClosed:
+			return fmt.Errorf("TCP 控制连接已关闭")
+		default:
+		}
+
+		if controlAddr != nil && !clientAddr.IP.Equal(controlAddr.IP) {
+			// 来源地址跟控制连接对不上，按 RFC 1928 §7 的要求静默丢弃。
+			continue
+		}
+
+		host, port, data, err := parseSocks5UDPHeader(buf[:n])
+		if err != nil {
+			// 畸形的数据包直接丢弃，不影响其它客户端/目标的转发。
+			continue
+		}
+
+		target := net.JoinHostPort(host, strconv.Itoa(port))
+		key := clientAddr.String() + "|" + target
+		tConn, ok := targets[key]
+		if !ok {
+			tConn, err = net.Dial("udp", target)
+			if err != nil {
+				continue
+			}
+			targets[key] = tConn
+			go h.relayUDPReplies(udpConn, tConn, clientAddr, host, port)
+		}
+
+		tConn.Write(data)
+	}
+}
+
+// relayUDPReplies 把目标回复的数据包重新套上 SOCKS5 UDP 头转发回客户端。
+func (h *socks5Handler) relayUDPReplies(udpConn *net.UDPConn, tConn net.Conn, clientAddr *net.UDPAddr, host string, port int) {
+	header := buildSocks5UDPHeader(host, port)
+	buf := make([]byte, 64*1024)
+	for {
+		tConn.SetReadDeadline(time.Now().Add(getHandlerTimeoutForward()))
+
+		n, err := tConn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		packet := append(append([]byte{}, header...), buf[:n]...)
+		if _, err := udpConn.WriteToUDP(packet, clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+// reply 按 RFC 1928 的格式写出一个 SOCKS5 响应。bindAddr 为 nil 时地址、端口都填 0，
+// 这在 CONNECT 命令里是合法的（很多实现也不关心 BND.ADDR/BND.PORT 的具体值）。
+func (h *socks5Handler) reply(w io.Writer, rep byte, bindAddr net.Addr) {
+	atyp := byte(socks5AtypIPv4)
+	ip := net.IPv4zero
+	port := 0
+
+	if bindAddr != nil {
+		if host, portStr, err := net.SplitHostPort(bindAddr.String()); err == nil {
+			if parsed := net.ParseIP(host); parsed != nil {
+				ip = parsed
+				if ip.To4() == nil {
+					atyp = socks5AtypIPv6
+				}
+			}
+			if p, err := strconv.Atoi(portStr); err == nil {
+				port = p
+			}
+		}
+	}
+
+	buf := []byte{socks5Version, rep, 0x00, atyp}
+	if atyp == socks5AtypIPv4 {
+		buf = append(buf, ip.To4()...)
+	}else {
+		buf = append(buf, ip.To16()...)
+	}
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, uint16(port))
+	buf = append(buf, portBuf...)
+
+	writeAll(w, buf)
+}
+
+// readSocks5Addr 读取 ATYP 之后的地址与端口字段，返回 "host:port"。
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	var host string
+
+	switch atyp {
+	case socks5AtypIPv4:
+		b, err := readN(r, 4)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(b).String()
+
+	case socks5AtypDomain:
+		lb, err := readN(r, 1)
+		if err != nil {
+			return "", err
+		}
+		b, err := readN(r, int(lb[0]))
+		if err != nil {
+			return "", err
+		}
+		host = string(b)
+
+	case socks5AtypIPv6:
+		b, err := readN(r, 16)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(b).String()
+
+	default:
+		return "", fmt.Errorf("不支持的地址类型：0x%x", atyp)
+	}
+
+	pb, err := readN(r, 2)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(pb)))), nil
+}
+
+// parseSocks5UDPHeader 解析 UDP ASSOCIATE 数据包的 SOCKS5 头
+// （IPv4 情形下共 10 字节：RSV(2) + FRAG(1) + ATYP(1) + DST.ADDR(4) + DST.PORT(2)），
+// 返回目标地址、端口和剩余的数据部分。不支持分片（FRAG != 0）。
+func parseSocks5UDPHeader(pkt []byte) (host string, port int, data []byte, err error) {
+	if len(pkt) < 4 {
+		return "", 0, nil, fmt.Errorf("数据包过短")
+	}
+	if pkt[2] != 0x00 {
+		return "", 0, nil, fmt.Errorf("不支持分片的 UDP 数据包")
+	}
+
+	atyp := pkt[3]
+	offset := 4
+
+	switch atyp {
+	case socks5AtypIPv4:
+		if len(pkt) < offset+4+2 {
+			return "", 0, nil, fmt.Errorf("IPv4 头过短")
+		}
+		host = net.IP(pkt[offset : offset+4]).String()
+		offset += 4
+
+	case socks5AtypDomain:
+		if len(pkt) < offset+1 {
+			return "", 0, nil, fmt.Errorf("域名头过短")
+		}
+		l := int(pkt[offset])
+		offset++
+		if len(pkt) < offset+l+2 {
+			return "", 0, nil, fmt.Errorf("域名头过短")
+		}
+		host = string(pkt[offset : offset+l])
+		offset += l
+
+	case socks5AtypIPv6:
+		if len(pkt) < offset+16+2 {
+			return "", 0, nil, fmt.Errorf("IPv6 头过短")
+		}
+		host = net.IP(pkt[offset : offset+16]).String()
+		offset += 16
+
+	default:
+		return "", 0, nil, fmt.Errorf("不支持的地址类型：0x%x", atyp)
+	}
+
+	port = int(binary.BigEndian.Uint16(pkt[offset : offset+2]))
+	offset += 2
+
+	return host, port, pkt[offset:], nil
+}
+
+// buildSocks5UDPHeader 构造与 parseSocks5UDPHeader 对应的 SOCKS5 UDP 头，用于回包。
+func buildSocks5UDPHeader(host string, port int) []byte {
+	ip := net.ParseIP(host)
+
+	var atyp byte
+	var addr []byte
+
+	switch {
+	case ip == nil:
+		atyp = socks5AtypDomain
+		addr = append([]byte{byte(len(host))}, []byte(host)...)
+	case ip.To4() != nil:
+		atyp = socks5AtypIPv4
+		addr = ip.To4()
+	default:
+		atyp = socks5AtypIPv6
+		addr = ip.To16()
+	}
+
+	header := []byte{0x00, 0x00, 0x00, atyp}
+	header = append(header, addr...)
+
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, uint16(port))
+
+	return append(header, portBuf...)
+}
+
+// readN 从 r 中读满 n 个字节。
+func readN(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeAll 把 p 完整写入 w，处理短写的情况。
+func writeAll(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSocks5HandleConnectReplaysConsumedBytesOnFailedSniff 复现和 proxyproto 里一样的场景：
+// 一个没有 Host 头的合法 HTTP/1.0 请求让 Pre() 返回 ok=false，但 ExtractHost 已经把请求
+// 字节读进了它返回的连接里，handleConnect 必须无条件改用这个连接。
+func TestSocks5HandleConnectReplaysConsumedBytesOnFailedSniff(t *testing.T) {
+	const request = "GET / HTTP/1.0\r\n\r\n"
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		// socks5Handler.reply 会先同步写出一个 10 字节的 SOCKS5 成功应答，必须先读走才能
+		// 继续往同一条管道里写应用层数据。
+		reply := make([]byte, 10)
+		io.ReadFull(clientConn, reply)
+		clientConn.Write([]byte(request))
+	}()
+
+	upstreamRead, upstreamWrite := net.Pipe()
+	defer upstreamRead.Close()
+	defer upstreamWrite.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(request))
+		io.ReadFull(upstreamRead, buf)
+		received <- buf
+	}()
+
+	newer := &socks5Newer{
+		dial:  func(network, address string) (net.Conn, error) { return upstreamWrite, nil },
+		count: &forwardCount{},
+	}
+	h := &socks5Handler{conn: serverConn, newer: newer}
+	go h.handleConnect("127.0.0.1:80")
+
+	select {
+	case got := <-received:
+		if string(got) != request {
+			t.Fatalf("期望转发出原始请求 %q，实际收到 %q", request, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("超时：嗅探消费掉的请求字节没有被转发出去")
+	}
+}